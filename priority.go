@@ -0,0 +1,239 @@
+package queue
+
+import "sync"
+
+// PriorityQueue orders elements by caller-supplied priority instead of insertion order. It
+// is implemented as an indirect binary heap: Add returns a stable handle into a separate
+// values array, and the heap itself stores only those handles, so a later Update or Fix can
+// relocate an element to its new heap position without callers having to track where it
+// currently lives in the heap.
+//
+// The values array grows the way Queue's ring buffer does (doubling on demand), but it never
+// shrinks: handles index it directly, and a grow only happens once every handle below the
+// current length has been handed out, so no part of it is ever free to give back.
+type PriorityQueue[T any] struct {
+	m    sync.Mutex
+	less func(a, b T) bool
+
+	keys []T   // keys[h] is the current value for handle h
+	heap []int // heap[0:count] is the heap of handles, heap[0] is the highest-priority handle
+	qp   []int // qp[h] is the position of handle h within heap, or -1 if h is not live
+
+	free       []int // freed handles available for reuse, most-recently-freed first
+	nextHandle int   // smallest handle never yet allocated
+
+	count   int
+	max_len int
+}
+
+// NewPriority constructs and returns a new PriorityQueue. less(a, b) should report whether
+// a has higher priority than b; PeekAndRemove returns an element for which no
+// higher-priority element exists. The order among elements of equal priority is not
+// defined: it is not necessarily the order in which Add put them in.
+func NewPriority[T any](max_len int, less func(a, b T) bool) *PriorityQueue[T] {
+	qp := make([]int, minQueueLen)
+	for i := range qp {
+		qp[i] = -1
+	}
+	return &PriorityQueue[T]{
+		less:    less,
+		keys:    make([]T, minQueueLen),
+		heap:    make([]int, minQueueLen),
+		qp:      qp,
+		max_len: max_len,
+	}
+}
+
+// Length returns the number of elements currently stored in the queue.
+func (pq *PriorityQueue[T]) Length() int {
+	return pq.count
+}
+
+func (pq *PriorityQueue[T]) grow() {
+	newCap := len(pq.keys) * 2
+
+	newKeys := make([]T, newCap)
+	newHeap := make([]int, newCap)
+	newQp := make([]int, newCap)
+	copy(newKeys, pq.keys)
+	copy(newHeap, pq.heap)
+	copy(newQp, pq.qp)
+	for i := len(pq.qp); i < newCap; i++ {
+		newQp[i] = -1
+	}
+
+	pq.keys, pq.heap, pq.qp = newKeys, newHeap, newQp
+}
+
+// shrink halves the arrays only if no handle at or above the new length was ever handed
+// out. allocHandle grows only when nextHandle reaches the current length and then hands out
+// that handle at once, so after any grow nextHandle exceeds half the length and shrink
+// returns without changing anything.
+func (pq *PriorityQueue[T]) shrink() {
+	newCap := len(pq.keys) / 2
+	if newCap < minQueueLen || pq.nextHandle > newCap {
+		return
+	}
+	pq.keys = pq.keys[:newCap]
+	pq.heap = pq.heap[:newCap]
+	pq.qp = pq.qp[:newCap]
+}
+
+func (pq *PriorityQueue[T]) allocHandle() int {
+	if n := len(pq.free); n > 0 {
+		h := pq.free[n-1]
+		pq.free = pq.free[:n-1]
+		return h
+	}
+	if pq.nextHandle == len(pq.keys) {
+		pq.grow()
+	}
+	h := pq.nextHandle
+	pq.nextHandle++
+	return h
+}
+
+func (pq *PriorityQueue[T]) lessAt(i, j int) bool {
+	return pq.less(pq.keys[pq.heap[i]], pq.keys[pq.heap[j]])
+}
+
+func (pq *PriorityQueue[T]) swap(i, j int) {
+	pq.heap[i], pq.heap[j] = pq.heap[j], pq.heap[i]
+	pq.qp[pq.heap[i]] = i
+	pq.qp[pq.heap[j]] = j
+}
+
+func (pq *PriorityQueue[T]) swim(k int) {
+	for k > 0 {
+		parent := (k - 1) / 2
+		if !pq.lessAt(k, parent) {
+			break
+		}
+		pq.swap(k, parent)
+		k = parent
+	}
+}
+
+func (pq *PriorityQueue[T]) sink(k int) {
+	for {
+		left := 2*k + 1
+		if left >= pq.count {
+			break
+		}
+		j := left
+		if right := left + 1; right < pq.count && pq.lessAt(right, left) {
+			j = right
+		}
+		if !pq.lessAt(j, k) {
+			break
+		}
+		pq.swap(k, j)
+		k = j
+	}
+}
+
+// Add puts elem into the queue and returns the handle later used to Update or Fix it. It
+// returns -1 without adding elem if the queue is already at max_len, mirroring Queue.Add's
+// drop-on-full behavior.
+func (pq *PriorityQueue[T]) Add(elem T) int {
+	pq.m.Lock()
+	defer pq.m.Unlock()
+
+	if pq.count >= pq.max_len {
+		return -1
+	}
+
+	h := pq.allocHandle()
+	pq.keys[h] = elem
+	pos := pq.count
+	pq.heap[pos] = h
+	pq.qp[h] = pos
+	pq.count++
+	pq.swim(pos)
+	return h
+}
+
+// Peek returns the highest-priority element in the queue. This call panics if the queue is
+// empty.
+func (pq *PriorityQueue[T]) Peek() T {
+	pq.m.Lock()
+	defer pq.m.Unlock()
+
+	if pq.count <= 0 {
+		panic("queue: Peek() called on empty queue")
+	}
+	return pq.keys[pq.heap[0]]
+}
+
+// PeekAndRemove removes and returns the highest-priority element in the queue. This call
+// panics if the queue is empty.
+func (pq *PriorityQueue[T]) PeekAndRemove() T {
+	pq.m.Lock()
+	defer pq.m.Unlock()
+
+	if pq.count <= 0 {
+		panic("queue: Remove() called on empty queue")
+	}
+
+	topHandle := pq.heap[0]
+	top := pq.keys[topHandle]
+
+	pq.count--
+	pq.heap[0] = pq.heap[pq.count]
+	pq.qp[pq.heap[0]] = 0
+	if pq.count > 0 {
+		pq.sink(0)
+	}
+
+	var zero T
+	pq.keys[topHandle] = zero
+	pq.qp[topHandle] = -1
+	pq.free = append(pq.free, topHandle)
+
+	if len(pq.keys) > minQueueLen && pq.count*4 == len(pq.keys) {
+		pq.shrink()
+	}
+	return top
+}
+
+// Get returns the element associated with handle i, as returned by Add. This call panics
+// if i is not a live handle.
+func (pq *PriorityQueue[T]) Get(i int) T {
+	pq.m.Lock()
+	defer pq.m.Unlock()
+
+	if i < 0 || i >= len(pq.qp) || pq.qp[i] == -1 {
+		panic("queue: Get() called with invalid handle")
+	}
+	return pq.keys[i]
+}
+
+// Update replaces the element associated with handle i and restores the heap invariant.
+// This call panics if i is not a live handle.
+func (pq *PriorityQueue[T]) Update(i int, elem T) {
+	pq.m.Lock()
+	defer pq.m.Unlock()
+
+	if i < 0 || i >= len(pq.qp) || pq.qp[i] == -1 {
+		panic("queue: Update() called with invalid handle")
+	}
+	pq.keys[i] = elem
+	pos := pq.qp[i]
+	pq.swim(pos)
+	pq.sink(pos)
+}
+
+// Fix restores the heap invariant for handle i after a caller has mutated its element in
+// place (e.g. through a pointer previously obtained via Get). This call panics if i is not
+// a live handle.
+func (pq *PriorityQueue[T]) Fix(i int) {
+	pq.m.Lock()
+	defer pq.m.Unlock()
+
+	if i < 0 || i >= len(pq.qp) || pq.qp[i] == -1 {
+		panic("queue: Fix() called with invalid handle")
+	}
+	pos := pq.qp[i]
+	pq.swim(pos)
+	pq.sink(pos)
+}
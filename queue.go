@@ -3,41 +3,69 @@ Package queue provides a fast, ring-buffer queue based on the version suggested
 Using this instead of other, simpler, queue implementations (slice+append or linked list) provides
 substantial memory and time benefits, and fewer GC pauses.
 
+Queue[T] is a double-ended queue: elements can be pushed/popped from either end, so it
+doubles as a FIFO queue and a LIFO stack (handy for work-stealing schedulers).
 */
 package queue
 
-import "sync"
-import "fmt"
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
 
+// minQueueLen must stay a power of two: buf's length is always a power of two so that
+// index arithmetic can use a bitmask (& (len(buf)-1)) instead of the slower % operator.
 const minQueueLen = 16
 
+// ErrDisposed is returned by the blocking pop variants once Stop has been called on the
+// queue. It is returned both to callers already parked in PopWait/PopWaitTimeout and to
+// any that call them afterwards once the queue is empty; elements still in the ring are
+// popped first. AddWait also returns it after Stop.
+var ErrDisposed = errors.New("queue: disposed")
+
 // Queue represents a single instance of the queue data structure.
-type Queue struct {
-	buf               []interface{}
+type Queue[T any] struct {
+	buf               []T
 	head, tail, count int
 	m                 sync.Mutex
-	c                 chan int
+	waiters           []chan struct{}
+	spaceWaiters      []chan struct{}
+	disposed          bool
 	max_len           int
+
+	// The fields below are only set on queues constructed with NewWithSpill/Open; see
+	// spill.go. They are zero-valued, and so no-ops, on every other queue.
+	spill *spillState[T]
 }
 
 // New constructs and returns a new Queue.
-func New(max_len int) *Queue {
-	return &Queue{
-		buf:     make([]interface{}, minQueueLen),
-		c:       make(chan int),
+func New[T any](max_len int) *Queue[T] {
+	return &Queue[T]{
+		buf:     make([]T, minQueueLen),
 		max_len: max_len,
 	}
 }
 
-// Length returns the number of elements currently stored in the queue.
-func (q *Queue) Length() int {
+// Length returns the number of elements currently stored in the queue, including any
+// spilled to disk (see NewWithSpill).
+func (q *Queue[T]) Length() int {
+	if q.spill != nil {
+		return q.count + q.spill.count
+	}
 	return q.count
 }
 
-// resizes the queue to fit exactly twice its current contents
-// this can result in shrinking if the queue is less than half-full
-func (q *Queue) resize() {
-	newBuf := make([]interface{}, q.count*2)
+// resizes the queue to the smallest power of two at least twice its current contents
+// (never below minQueueLen); this can result in shrinking if the queue is less than
+// half-full. The result must stay a power of two: see the minQueueLen comment.
+func (q *Queue[T]) resize() {
+	newCap := minQueueLen
+	for newCap < q.count*2 {
+		newCap *= 2
+	}
+	newBuf := make([]T, newCap)
 
 	if q.tail > q.head {
 		copy(newBuf, q.buf[q.head:q.tail])
@@ -51,8 +79,163 @@ func (q *Queue) resize() {
 	q.buf = newBuf
 }
 
-// Add puts an element on the end of the queue.
-func (q *Queue) Add(elem interface{}) {
+// wakeOneWaiter notifies the oldest parked PopWait/PopWaitTimeout caller, if any, that an
+// element is now available. Must be called with q.m held.
+func (q *Queue[T]) wakeOneWaiter() {
+	if len(q.waiters) == 0 {
+		return
+	}
+	ch := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	close(ch)
+}
+
+// removeWaiter drops ch from the waiter list, e.g. after its PopWait's context was
+// cancelled before a wakeup reached it. If ch was already closed by wakeOneWaiter, the
+// wakeup it carried would otherwise be lost along with the caller giving up on it, so
+// removeWaiter passes it on to the next waiter in line instead.
+func (q *Queue[T]) removeWaiter(ch chan struct{}) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for i, w := range q.waiters {
+		if w == ch {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return
+		}
+	}
+	q.wakeOneWaiter()
+}
+
+// wakeOneSpaceWaiter notifies the oldest parked AddWait caller, if any, that there is now
+// room for another element. Must be called with q.m held.
+func (q *Queue[T]) wakeOneSpaceWaiter() {
+	if len(q.spaceWaiters) == 0 {
+		return
+	}
+	ch := q.spaceWaiters[0]
+	q.spaceWaiters = q.spaceWaiters[1:]
+	close(ch)
+}
+
+// removeSpaceWaiter drops ch from the space-waiter list, e.g. after its AddWait's context
+// was cancelled before a wakeup reached it. If ch was already closed by wakeOneSpaceWaiter,
+// the wakeup it carried would otherwise be lost along with the caller giving up on it, so
+// removeSpaceWaiter passes it on to the next waiter in line instead.
+func (q *Queue[T]) removeSpaceWaiter(ch chan struct{}) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for i, w := range q.spaceWaiters {
+		if w == ch {
+			q.spaceWaiters = append(q.spaceWaiters[:i], q.spaceWaiters[i+1:]...)
+			return
+		}
+	}
+	q.wakeOneSpaceWaiter()
+}
+
+// pushBackLocked puts elem on the end of the queue. q.m must be held and the caller must
+// have already checked q.count < q.max_len.
+func (q *Queue[T]) pushBackLocked(elem T) {
+	if q.count == len(q.buf) {
+		q.resize()
+	}
+	q.buf[q.tail] = elem
+	q.tail = (q.tail + 1) & (len(q.buf) - 1)
+	q.count++
+	q.wakeOneWaiter()
+}
+
+// Add puts an element on the end of the queue, silently dropping it if the queue is
+// already at max_len. See AddWait and TryAdd for variants that report back pressure. A
+// queue constructed with NewWithSpill spills to disk instead of dropping, and once
+// anything has spilled, Add keeps spilling even while the ring has free slots: pushing a
+// new arrival straight into the ring while older elements are still sitting on disk would
+// let it jump ahead of them. Add has no error return, so a spill write failure is dropped
+// the same as a drop-on-full would be; callers that need to know about it should use
+// AddWait instead.
+func (q *Queue[T]) Add(elem T) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.spill != nil && (q.count >= q.max_len || q.spill.count > 0) {
+		q.spill.add(elem)
+		return
+	}
+	if q.count >= q.max_len {
+		return
+	}
+	q.pushBackLocked(elem)
+}
+
+// AddOrDrop is Add under an explicit name, for call sites that want the drop-on-full
+// behavior to be unambiguous alongside AddWait and TryAdd.
+func (q *Queue[T]) AddOrDrop(elem T) {
+	q.Add(elem)
+}
+
+// TryAdd puts an element on the end of the queue without blocking. It reports false if
+// the queue was disposed or already at max_len. As with AddWait, once anything has spilled
+// to disk, TryAdd spills elem too, and reports false if that write fails.
+func (q *Queue[T]) TryAdd(elem T) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.disposed {
+		return false
+	}
+	if q.spill != nil && q.spill.count > 0 {
+		return q.spill.add(elem) == nil
+	}
+	if q.count >= q.max_len {
+		return false
+	}
+	q.pushBackLocked(elem)
+	return true
+}
+
+// AddWait puts an element on the end of the queue, blocking the producer until space is
+// available, the queue is stopped, or ctx is done. It never leaks a goroutine: callers
+// that give up via ctx are removed from the waiter list instead of being left parked. As
+// with Add, once anything has spilled to disk, AddWait keeps spilling instead of waiting
+// for ring space, so disk data stays strictly older than anything that re-enters the ring.
+// Unlike Add, AddWait reports a spill write failure instead of dropping elem: it is the
+// entry point callers who need the "nothing is lost" guarantee of a spill-backed queue
+// should use.
+func (q *Queue[T]) AddWait(ctx context.Context, elem T) error {
+	for {
+		q.m.Lock()
+		if q.disposed {
+			q.m.Unlock()
+			return ErrDisposed
+		}
+		if q.spill != nil && q.spill.count > 0 {
+			err := q.spill.add(elem)
+			q.m.Unlock()
+			return err
+		}
+		if q.count < q.max_len {
+			q.pushBackLocked(elem)
+			q.m.Unlock()
+			return nil
+		}
+		ch := make(chan struct{})
+		q.spaceWaiters = append(q.spaceWaiters, ch)
+		q.m.Unlock()
+
+		select {
+		case <-ch:
+			// Woken up; loop around and retry the push.
+		case <-ctx.Done():
+			q.removeSpaceWaiter(ch)
+			return ctx.Err()
+		}
+	}
+}
+
+// AddFront puts an element on the front of the queue, for deque / LIFO use.
+func (q *Queue[T]) AddFront(elem T) {
 	q.m.Lock()
 	defer q.m.Unlock()
 
@@ -63,17 +246,15 @@ func (q *Queue) Add(elem interface{}) {
 		q.resize()
 	}
 
-	q.buf[q.tail] = elem
-	q.tail = (q.tail + 1) % len(q.buf)
+	q.head = (q.head - 1) & (len(q.buf) - 1)
+	q.buf[q.head] = elem
 	q.count++
-	go func() {
-		q.c <- 1
-	}()
+	q.wakeOneWaiter()
 }
 
 // Peek returns the element at the head of the queue. This call panics
 // if the queue is empty.
-func (q *Queue) Peek() interface{} {
+func (q *Queue[T]) Peek() T {
 	q.m.Lock()
 	defer q.m.Unlock()
 
@@ -83,61 +264,250 @@ func (q *Queue) Peek() interface{} {
 	return q.buf[q.head]
 }
 
+// PeekBack returns the element at the tail of the queue. This call panics
+// if the queue is empty.
+func (q *Queue[T]) PeekBack() T {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.count <= 0 {
+		panic("queue: PeekBack() called on empty queue")
+	}
+	return q.buf[(q.tail-1)&(len(q.buf)-1)]
+}
+
 // Get returns the element at index i in the queue. If the index is
 // invalid, the call will panic.
-func (q *Queue) Get(i int) interface{} {
+func (q *Queue[T]) Get(i int) T {
 	q.m.Lock()
 	defer q.m.Unlock()
 
 	if i < 0 || i >= q.count {
 		panic("queue: Get() called with index out of range")
 	}
-	return q.buf[(q.head+i)%len(q.buf)]
+	return q.buf[(q.head+i)&(len(q.buf)-1)]
+}
+
+// Range calls fn for each element from front to back, holding the queue's lock for the
+// whole call so the iteration sees a consistent view. It stops early if fn returns false.
+// fn must not call back into q. Elements spilled to disk (see NewWithSpill) are not visited.
+func (q *Queue[T]) Range(fn func(i int, elem T) bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for i := 0; i < q.count; i++ {
+		if !fn(i, q.buf[(q.head+i)&(len(q.buf)-1)]) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a copy of every element currently in the queue, front to back, taken
+// under a single lock acquisition. Only the in-memory ring is copied: elements spilled to
+// disk (see NewWithSpill) are not included.
+func (q *Queue[T]) Snapshot() []T {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	out := make([]T, q.count)
+	for i := range out {
+		out[i] = q.buf[(q.head+i)&(len(q.buf)-1)]
+	}
+	return out
+}
+
+// popFrontLocked removes and returns the element at the front of the queue. q.m must be
+// held and q.count must be > 0.
+func (q *Queue[T]) popFrontLocked() T {
+	h := q.buf[q.head]
+	var zero T
+	q.buf[q.head] = zero
+	q.head = (q.head + 1) & (len(q.buf) - 1)
+	q.count--
+	if len(q.buf) > minQueueLen && q.count*4 == len(q.buf) {
+		q.resize()
+	}
+	q.wakeOneSpaceWaiter()
+	if q.spill != nil && q.count <= q.spill.lowWater {
+		q.spill.refill(q)
+	}
+	return h
 }
 
 // Remove removes the element from the front of the queue. If you actually
 // want the element, call Peek first. This call panics if the queue is empty.
-func (q *Queue) Remove() {
+func (q *Queue[T]) Remove() {
 	q.m.Lock()
 	defer q.m.Unlock()
 
 	if q.count <= 0 {
 		panic("queue: Remove() called on empty queue")
 	}
-	q.buf[q.head] = nil
-	q.head = (q.head + 1) % len(q.buf)
+	q.popFrontLocked()
+}
+
+// PopBack removes and returns the element from the back of the queue, for
+// deque / LIFO use. This call panics if the queue is empty.
+func (q *Queue[T]) PopBack() T {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.count <= 0 {
+		panic("queue: PopBack() called on empty queue")
+	}
+	q.tail = (q.tail - 1) & (len(q.buf) - 1)
+	t := q.buf[q.tail]
+	var zero T
+	q.buf[q.tail] = zero
 	q.count--
 	if len(q.buf) > minQueueLen && q.count*4 == len(q.buf) {
 		q.resize()
 	}
+	q.wakeOneSpaceWaiter()
+	return t
 }
 
-func (q *Queue) PeekAndRemove() interface{} {
+func (q *Queue[T]) PeekAndRemove() T {
 	q.m.Lock()
 	defer q.m.Unlock()
 
 	if q.count <= 0 {
 		panic("queue: Remove() called on empty queue")
 	}
-	h := q.buf[q.head]
-	q.buf[q.head] = nil
-	q.head = (q.head + 1) % len(q.buf)
-	q.count--
-	if len(q.buf) > minQueueLen && q.count*4 == len(q.buf) {
-		q.resize()
+	return q.popFrontLocked()
+}
+
+// TryPop removes and returns the element at the front of the queue without blocking. The
+// second return value is false if the queue was empty.
+func (q *Queue[T]) TryPop() (T, bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.count <= 0 {
+		var zero T
+		return zero, false
 	}
-	return h
+	return q.popFrontLocked(), true
 }
 
-func (q *Queue) Wait() error {
-	x, ok := <-q.c
-	if ok && x == 1 {
+// drainLocked removes and returns up to n elements from the front of the queue in a single
+// pass, for DrainN/DrainAll. Unlike popFrontLocked, it wakes at most one space-waiter and
+// triggers at most one spill refill for the whole batch rather than one per element, which
+// is what makes it cheaper than looping PeekAndRemove for batch consumers. q.m must be
+// held.
+func (q *Queue[T]) drainLocked(n int) []T {
+	if n > q.count {
+		n = q.count
+	}
+	if n <= 0 {
 		return nil
 	}
-	return fmt.Errorf("Queue Stopped")
+
+	out := make([]T, n)
+	for i := range out {
+		out[i] = q.buf[q.head]
+		var zero T
+		q.buf[q.head] = zero
+		q.head = (q.head + 1) & (len(q.buf) - 1)
+	}
+	q.count -= n
+
+	if len(q.buf) > minQueueLen && q.count*4 <= len(q.buf) {
+		q.resize()
+	}
+
+	q.wakeOneSpaceWaiter()
+	if q.spill != nil {
+		q.spill.refill(q)
+	}
+	return out
+}
+
+// DrainN removes and returns up to n elements from the front of the queue in a single lock
+// acquisition. It returns fewer than n elements if the queue holds fewer than n, and nil if
+// the queue is empty. Only the in-memory ring is drained: on a queue constructed with
+// NewWithSpill/Open, spilled elements are not returned but refill the ring afterwards.
+func (q *Queue[T]) DrainN(n int) []T {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return q.drainLocked(n)
+}
+
+// DrainAll removes and returns every element currently in the in-memory ring in a single
+// lock acquisition. It returns nil if the ring is empty. On a queue constructed with
+// NewWithSpill/Open, spilled elements are not returned but refill the ring afterwards.
+func (q *Queue[T]) DrainAll() []T {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	return q.drainLocked(q.count)
+}
+
+// PopWait removes and returns the element at the front of the queue, blocking until one
+// is available, the queue is stopped, or ctx is done. It never leaks a goroutine: callers
+// that give up via ctx are removed from the waiter list instead of being left parked.
+func (q *Queue[T]) PopWait(ctx context.Context) (T, error) {
+	for {
+		q.m.Lock()
+		if q.count > 0 {
+			v := q.popFrontLocked()
+			q.m.Unlock()
+			return v, nil
+		}
+		if q.disposed {
+			q.m.Unlock()
+			var zero T
+			return zero, ErrDisposed
+		}
+		ch := make(chan struct{})
+		q.waiters = append(q.waiters, ch)
+		q.m.Unlock()
+
+		select {
+		case <-ch:
+			// Woken up; loop around and retry the pop.
+		case <-ctx.Done():
+			q.removeWaiter(ch)
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// PopWaitTimeout is PopWait with a relative timeout instead of a caller-supplied context.
+func (q *Queue[T]) PopWaitTimeout(d time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return q.PopWait(ctx)
 }
 
-func (q *Queue) Stop() {
-	q.c <- 0
-	close(q.c)
+// Stop disposes of the queue, unblocking every pending PopWait/PopWaitTimeout/AddWait call
+// with ErrDisposed. On a queue constructed with NewWithSpill/Open, it also spills whatever
+// is still in the in-memory ring and flushes/syncs the open spill segment, so the queue can
+// be recovered in full with Open after a restart; Stop reports an error if it could not
+// persist the ring to disk, rather than silently losing it, though the queue is disposed
+// and its waiters unblocked either way. It is safe to call Stop more than once.
+func (q *Queue[T]) Stop() error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.disposed {
+		return nil
+	}
+	q.disposed = true
+	var err error
+	if q.spill != nil {
+		err = q.spill.drainRingToDisk(q)
+		q.spill.flush()
+	}
+	for _, ch := range q.waiters {
+		close(ch)
+	}
+	q.waiters = nil
+	for _, ch := range q.spaceWaiters {
+		close(ch)
+	}
+	q.spaceWaiters = nil
+	return err
 }
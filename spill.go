@@ -0,0 +1,429 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSegmentBytes bounds how large a single on-disk segment file is allowed to grow before
+// a fresh one is started.
+const maxSegmentBytes = 4 << 20 // 4 MiB
+
+// ringSegmentName holds whatever was still in the in-memory ring at Stop, written out by
+// drainRingToDisk. It is always read before any segment-NNNN.seg file: the ring holds the
+// oldest unconsumed elements in the whole queue (everything on disk only ever got there
+// because it arrived after the ring was already full), so on recovery it must come first.
+const ringSegmentName = "ring.seg"
+
+// Codec encodes and decodes elements for the disk-backed overflow segment used by
+// NewWithSpill and Open.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// GobCodec is the default Codec, encoding elements with encoding/gob.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// segment describes a closed, fully-written segment file awaiting drain.
+type segment struct {
+	path  string
+	count int
+}
+
+// spillState holds the disk-overflow bookkeeping for a Queue constructed with
+// NewWithSpill/Open. It is only reachable through Queue.spill, always under q.m.
+type spillState[T any] struct {
+	dir      string
+	codec    Codec[T]
+	lowWater int
+
+	count int // elements currently on disk, across pending and write segments
+
+	pending []segment // closed segments awaiting drain, oldest first
+
+	writeSeg   *os.File
+	writeSeq   int
+	writePath  string
+	writeSize  int
+	writeCount int
+
+	readSeg   *os.File
+	readPath  string
+	readCount int // records remaining unread in readSeg
+}
+
+// NewWithSpill constructs a Queue whose Add spills elements to disk, under dir, instead of
+// dropping them once memCap in-memory elements are queued. PeekAndRemove (and the other
+// front-popping methods) transparently pull spilled elements back into memory once the
+// in-memory ring drains to a quarter of memCap. codec controls how elements are encoded on
+// disk; a nil codec defaults to GobCodec[T]{}.
+//
+// NewWithSpill assumes dir is either new or empty. To recover a queue left on disk by a
+// prior process, use Open instead. AddFront and PopBack are not spill-aware and should not
+// be used on a queue constructed with NewWithSpill.
+func NewWithSpill[T any](memCap int, dir string, codec Codec[T]) (*Queue[T], error) {
+	if codec == nil {
+		codec = GobCodec[T]{}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := New[T](memCap)
+	q.spill = &spillState[T]{
+		dir:      dir,
+		codec:    codec,
+		lowWater: lowWaterFor(memCap),
+	}
+	return q, nil
+}
+
+// Open recovers a queue previously written to dir by a Queue constructed with
+// NewWithSpill/Open whose Stop was called (or that otherwise left segment files behind),
+// making it crash-recoverable. codec must match the one the segments were written with; a
+// nil codec defaults to GobCodec[T]{}.
+func Open[T any](dir string, memCap int, codec Codec[T]) (*Queue[T], error) {
+	if codec == nil {
+		codec = GobCodec[T]{}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []segment
+	maxSeq := -1
+	for _, ent := range entries {
+		if ent.IsDir() {
+			continue
+		}
+		seq, ok := parseSegmentName(ent.Name())
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, ent.Name())
+		count, err := countSegmentRecords(path)
+		if err != nil {
+			return nil, fmt.Errorf("queue: recovering %s: %w", path, err)
+		}
+		if count == 0 {
+			os.Remove(path)
+			continue
+		}
+		segs = append(segs, segment{path: path, count: count})
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].path < segs[j].path })
+
+	ringPath := filepath.Join(dir, ringSegmentName)
+	if _, err := os.Stat(ringPath); err == nil {
+		count, err := countSegmentRecords(ringPath)
+		if err != nil {
+			return nil, fmt.Errorf("queue: recovering %s: %w", ringPath, err)
+		}
+		if count == 0 {
+			os.Remove(ringPath)
+		} else {
+			segs = append([]segment{{path: ringPath, count: count}}, segs...)
+		}
+	}
+
+	total := 0
+	for _, s := range segs {
+		total += s.count
+	}
+
+	q := New[T](memCap)
+	q.spill = &spillState[T]{
+		dir:      dir,
+		codec:    codec,
+		lowWater: lowWaterFor(memCap),
+		pending:  segs,
+		writeSeq: maxSeq + 1,
+		count:    total,
+	}
+
+	q.m.Lock()
+	q.spill.refill(q)
+	q.m.Unlock()
+
+	return q, nil
+}
+
+func lowWaterFor(memCap int) int {
+	lw := memCap / 4
+	if lw < 1 {
+		lw = 1
+	}
+	return lw
+}
+
+func segmentName(seq int) string {
+	return fmt.Sprintf("segment-%020d.seg", seq)
+}
+
+func parseSegmentName(name string) (int, bool) {
+	if !strings.HasPrefix(name, "segment-") || !strings.HasSuffix(name, ".seg") {
+		return 0, false
+	}
+	numPart := strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), ".seg")
+	seq, err := strconv.Atoi(numPart)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// countSegmentRecords scans a segment file's length prefixes to count its records without
+// decoding them.
+func countSegmentRecords(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var hdr [4]byte
+	count := 0
+	for {
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// add spills elem to the currently open write segment, opening or rotating it as needed.
+// It reports the first codec or I/O error encountered instead of dropping elem silently:
+// a queue built with NewWithSpill promises not to lose data, and swallowing a write failure
+// here would break that promise without telling anyone. Add ignores this error to keep its
+// own drop-on-full contract; AddWait propagates it, since it is the entry point callers
+// rely on for delivery.
+func (s *spillState[T]) add(elem T) error {
+	data, err := s.codec.Marshal(elem)
+	if err != nil {
+		return fmt.Errorf("queue: spilling element: %w", err)
+	}
+
+	if s.writeSeg != nil && s.writeSize+4+len(data) > maxSegmentBytes && s.writeCount > 0 {
+		s.closeWriteSegment()
+	}
+	if s.writeSeg == nil {
+		if err := s.openWriteSegment(); err != nil {
+			return fmt.Errorf("queue: spilling element: %w", err)
+		}
+	}
+
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err := s.writeSeg.Write(hdr[:]); err != nil {
+		return fmt.Errorf("queue: spilling element: %w", err)
+	}
+	if _, err := s.writeSeg.Write(data); err != nil {
+		return fmt.Errorf("queue: spilling element: %w", err)
+	}
+	s.writeSize += 4 + len(data)
+	s.writeCount++
+	s.count++
+	return nil
+}
+
+func (s *spillState[T]) openWriteSegment() error {
+	path := filepath.Join(s.dir, segmentName(s.writeSeq))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	s.writeSeg = f
+	s.writePath = path
+	s.writeSize = 0
+	s.writeCount = 0
+	s.writeSeq++
+	return nil
+}
+
+func (s *spillState[T]) closeWriteSegment() {
+	if s.writeSeg == nil {
+		return
+	}
+	s.writeSeg.Sync()
+	s.writeSeg.Close()
+	if s.writeCount > 0 {
+		s.pending = append(s.pending, segment{path: s.writePath, count: s.writeCount})
+	} else {
+		os.Remove(s.writePath)
+	}
+	s.writeSeg = nil
+}
+
+// flush closes the open write segment so it is readable by a later Open, and rewrites the
+// segment currently being drained, if any, down to just its unread tail: reading never
+// modifies a segment file in place, so without this the records already pulled into memory
+// this session would be re-delivered by the next Open. Called from Queue.Stop.
+func (s *spillState[T]) flush() {
+	s.closeWriteSegment()
+	s.persistReadSegment()
+}
+
+// drainRingToDisk writes every element still sitting in q's in-memory ring out to
+// ringSegmentName and empties the ring, so Stop followed by Open recovers the whole queue
+// rather than just what had already spilled. q.m must be held; called from Queue.Stop
+// before flush. It reports the first codec or I/O error encountered and leaves the ring
+// untouched in that case, rather than silently losing whatever didn't make it to disk.
+func (s *spillState[T]) drainRingToDisk(q *Queue[T]) error {
+	if q.count == 0 {
+		return nil
+	}
+
+	path := filepath.Join(s.dir, ringSegmentName)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("queue: spilling ring to %s: %w", path, err)
+	}
+	defer f.Close()
+
+	written := 0
+	for i := 0; i < q.count; i++ {
+		elem := q.buf[(q.head+i)&(len(q.buf)-1)]
+		data, err := s.codec.Marshal(elem)
+		if err != nil {
+			os.Remove(path)
+			return fmt.Errorf("queue: spilling ring to %s: %w", path, err)
+		}
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+		if _, err := f.Write(hdr[:]); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("queue: spilling ring to %s: %w", path, err)
+		}
+		if _, err := f.Write(data); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("queue: spilling ring to %s: %w", path, err)
+		}
+		written++
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("queue: spilling ring to %s: %w", path, err)
+	}
+
+	s.count += written
+	q.count, q.head, q.tail = 0, 0, 0
+	return nil
+}
+
+func (s *spillState[T]) persistReadSegment() {
+	if s.readSeg == nil {
+		return
+	}
+	defer func() {
+		s.readSeg.Close()
+		s.readSeg = nil
+	}()
+
+	if s.readCount == 0 {
+		os.Remove(s.readPath)
+		return
+	}
+
+	tmpPath := s.readPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	if _, err := io.Copy(out, s.readSeg); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return
+	}
+	out.Sync()
+	out.Close()
+	os.Rename(tmpPath, s.readPath)
+}
+
+// refill pulls spilled elements back into q's in-memory ring until it reaches q.max_len or
+// the disk is drained. Must be called with q.m held.
+func (s *spillState[T]) refill(q *Queue[T]) {
+	for q.count < q.max_len && s.count > 0 {
+		if s.readSeg == nil {
+			if len(s.pending) == 0 {
+				s.closeWriteSegment()
+				if len(s.pending) == 0 {
+					return
+				}
+			}
+			seg := s.pending[0]
+			s.pending = s.pending[1:]
+			f, err := os.Open(seg.path)
+			if err != nil {
+				return
+			}
+			s.readSeg = f
+			s.readPath = seg.path
+			s.readCount = seg.count
+		}
+
+		elem, err := s.readOneRecord()
+		if err != nil {
+			s.readSeg.Close()
+			s.readSeg = nil
+			return
+		}
+		q.pushBackLocked(elem)
+		s.count--
+		s.readCount--
+		if s.readCount == 0 {
+			s.readSeg.Close()
+			os.Remove(s.readPath)
+			s.readSeg = nil
+		}
+	}
+}
+
+func (s *spillState[T]) readOneRecord() (T, error) {
+	var zero T
+	var hdr [4]byte
+	if _, err := io.ReadFull(s.readSeg, hdr[:]); err != nil {
+		return zero, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.readSeg, data); err != nil {
+		return zero, err
+	}
+	return s.codec.Unmarshal(data)
+}